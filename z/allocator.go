@@ -19,7 +19,6 @@ package z
 import (
 	"fmt"
 	"math"
-	"math/bits"
 	"math/rand"
 	"strings"
 	"sync"
@@ -36,12 +35,34 @@ import (
 // Once allocated, the memory is not moved, so it is safe to use the allocated bytes to unsafe cast
 // them to Go struct pointers. Maintaining a freelist is slow.  Instead, Allocator only allocates
 // memory, with the idea that finally we would just release the entire Allocator.
+//
+// To avoid a single bump pointer becoming a contention point under concurrent use, the bump
+// pointer is sharded: each shard owns its own run of buffers and its own cursor, and Allocate
+// spreads calls across shards so most of them only ever touch their own shard's cache line.
+// Shard buffer slices are fixed-size and grown by setting individual elements (never by
+// appending), same as buffers used to be, so that reading a slot in one goroutine can never
+// race with another goroutine resizing the slice header.
+//
+// Buffers come from the Go heap unless the Allocator was created by
+// NewAllocatorWithOptions with WithMmap, WithHugePages or WithGigabyteHugePages,
+// in which case they come from an anonymous mmap where the OS allows it.
 type Allocator struct {
 	sync.Mutex
-	compIdx uint64 // Stores bufIdx in 32 MSBs and posIdx in 32 LSBs.
-	buffers [][]byte
-	Ref     uint64
-	Tag     string
+	Ref uint64
+	Tag string
+
+	backend     allocBackend
+	initialSize int
+	shards      []*allocShard
+	shardPick   uint64
+	// noZero, when set via WithNoZero, skips zeroing buffers recycled from the
+	// global buffer pool. Only safe when the caller overwrites before reading.
+	noZero bool
+
+	// classFreelists holds one freelist head per entry in sizeClasses, each
+	// guarded by the matching entry in classMus. Used by AllocateClass/FreeClass.
+	classFreelists []unsafe.Pointer
+	classMus       []sync.Mutex
 }
 
 // allocs keeps references to all Allocators, so we can safely discard them later.
@@ -64,26 +85,36 @@ func init() {
 	}
 }
 
-// NewAllocator creates an allocator starting with the given size.
+// NewAllocator creates an allocator starting with the given size, using plain Go
+// heap memory for its buffers. Use NewAllocatorWithOptions to back the Allocator
+// with mmap or huge pages instead.
 func NewAllocator(sz int) *Allocator {
+	return NewAllocatorWithOptions(sz)
+}
+
+// NewAllocatorWithOptions is like NewAllocator, but lets the caller pick where the
+// Allocator's buffers come from via opts (see WithMmap, WithHugePages and
+// WithGigabyteHugePages).
+func NewAllocatorWithOptions(sz int, opts ...AllocatorOption) *Allocator {
 	ref := atomic.AddUint64(&allocRef, 1)
-	// We should not allow a zero sized page because addBufferWithMinSize
-	// will run into an infinite loop trying to double the pagesize.
+	// We should not allow a zero sized page because growShard will run into an
+	// infinite loop trying to double the pagesize.
 	if sz <= 0 {
 		sz = 512
 	}
 	a := &Allocator{
-		Ref:     ref,
-		buffers: make([][]byte, 32),
+		Ref:            ref,
+		initialSize:    sz,
+		classFreelists: make([]unsafe.Pointer, len(sizeClasses)),
+		classMus:       make([]sync.Mutex, len(sizeClasses)),
 	}
-
-	l2 := uint64(log2(sz))
-	if bits.OnesCount64(uint64(sz)) > 1 {
-		// If l2 is a power of 2, then we can allocate the requested size of data. Otherwise, we
-		// bump up to the next power of 2.
-		l2 += 1
+	for _, opt := range opts {
+		opt(a)
 	}
-	a.buffers[0] = make([]byte, 1<<l2)
+	if sz > a.effectiveMaxAlloc() {
+		panic(fmt.Sprintf("Unable to allocate more than %d\n", a.effectiveMaxAlloc()))
+	}
+	a.shards = a.newShards()
 
 	allocsMu.Lock()
 	allocs[ref] = a
@@ -91,8 +122,12 @@ func NewAllocator(sz int) *Allocator {
 	return a
 }
 
+// Reset rewinds every shard's cursor back to the start of its first buffer, so
+// the already-allocated buffers can be reused from scratch.
 func (a *Allocator) Reset() {
-	atomic.StoreUint64(&a.compIdx, 0)
+	for _, sh := range a.shards {
+		atomic.StoreUint64(&sh.compIdx, 0)
+	}
 }
 
 func PrintAllocators() {
@@ -111,16 +146,18 @@ func (a *Allocator) String() string {
 	var s strings.Builder
 	s.WriteString(fmt.Sprintf("Allocator: %x\n", a.Ref))
 	var cum int
-	for i, b := range a.buffers {
-		cum += len(b)
-		if len(b) == 0 {
-			break
+	for shardIdx, sh := range a.shards {
+		for i, b := range sh.buffers {
+			if len(b) == 0 {
+				break
+			}
+			cum += len(b)
+			s.WriteString(fmt.Sprintf("shard: %d idx: %d len: %d cum: %d\n", shardIdx, i, len(b), cum))
 		}
-		s.WriteString(fmt.Sprintf("idx: %d len: %d cum: %d\n", i, len(b), cum))
+		pos := atomic.LoadUint64(&sh.compIdx)
+		bi, pi := parse(pos)
+		s.WriteString(fmt.Sprintf("shard: %d bi: %d pi: %d\n", shardIdx, bi, pi))
 	}
-	pos := atomic.LoadUint64(&a.compIdx)
-	bi, pi := parse(pos)
-	s.WriteString(fmt.Sprintf("bi: %d pi: %d\n", bi, pi))
 	s.WriteString(fmt.Sprintf("Size: %d\n", a.Size()))
 	return s.String()
 }
@@ -137,20 +174,22 @@ func parse(pos uint64) (bufIdx, posIdx int) {
 	return int(pos >> 32), int(pos & 0xFFFFFFFF)
 }
 
-// Size returns the size of the allocations so far.
+// Size returns the size of the allocations so far, summed across all shards.
 func (a *Allocator) Size() int {
-	pos := atomic.LoadUint64(&a.compIdx)
-	bi, pi := parse(pos)
 	var sz int
-	for i, b := range a.buffers {
-		if i < bi {
-			sz += len(b)
-			continue
+	for _, sh := range a.shards {
+		pos := atomic.LoadUint64(&sh.compIdx)
+		bi, pi := parse(pos)
+		for i, b := range sh.buffers {
+			if i < bi {
+				sz += len(b)
+				continue
+			}
+			sz += pi
+			break
 		}
-		sz += pi
-		return sz
 	}
-	panic("Size should not reach here")
+	return sz
 }
 
 func log2(sz int) int {
@@ -168,18 +207,39 @@ func log2(sz int) int {
 
 func (a *Allocator) Allocated() uint64 {
 	var alloc int
-	for _, b := range a.buffers {
-		alloc += cap(b)
+	for _, sh := range a.shards {
+		for _, b := range sh.buffers {
+			alloc += cap(b)
+		}
 	}
 	return uint64(alloc)
 }
 
 // Release would release the memory back. Remember to make this call to avoid memory leaks.
+//
+// Non-empty buffers are first offered to the global buffer pool (see
+// SetBufferPoolLimits) so a future Allocator can reuse them instead of making a
+// fresh allocation or mmap call. Buffers the pool doesn't accept are released
+// the old way: munmapped if they came from mmap, or left for the GC otherwise.
 func (a *Allocator) Release() {
 	if a == nil {
 		return
 	}
 
+	for _, sh := range a.shards {
+		for i, buf := range sh.buffers {
+			if len(buf) == 0 {
+				continue
+			}
+			mapped := sh.mmapped[i]
+			if !globalBufferPool.put(buf, mapped) && mapped {
+				if err := munmapFree(buf); err != nil {
+					panic(err)
+				}
+			}
+		}
+	}
+
 	allocsMu.Lock()
 	delete(allocs, a.Ref)
 	allocsMu.Unlock()
@@ -191,6 +251,17 @@ func (a *Allocator) MaxAlloc() int {
 	return maxAlloc
 }
 
+// effectiveMaxAlloc returns the largest size a single Allocate call may request.
+// It is the same as MaxAlloc, unless the Allocator was configured to use huge
+// pages smaller than maxAlloc, in which case a single request can't exceed the
+// huge page size. Buffers grown by growShard may still be bigger than that.
+func (a *Allocator) effectiveMaxAlloc() int {
+	if hp := a.backend.hugePageSize(); hp > 0 && hp < maxAlloc {
+		return hp
+	}
+	return maxAlloc
+}
+
 const nodeAlign = unsafe.Sizeof(uint64(0)) - 1
 
 func (a *Allocator) AllocateAligned(sz int) []byte {
@@ -213,64 +284,36 @@ func (a *Allocator) Copy(buf []byte) []byte {
 	return out
 }
 
-func (a *Allocator) addBufferAt(bufIdx, minSz int) {
-	for {
-		if bufIdx >= len(a.buffers) {
-			panic(fmt.Sprintf("Allocator can not allocate more than %d buffers", len(a.buffers)))
-		}
-		if len(a.buffers[bufIdx]) == 0 {
-			break
-		}
-		if minSz <= len(a.buffers[bufIdx]) {
-			// No need to do anything. We already have a buffer which can satisfy minSz.
-			return
-		}
-		bufIdx++
-	}
-	assert(bufIdx > 0)
-	// We need to allocate a new buffer.
-	// Make pageSize double of the last allocation.
-	pageSize := 2 * len(a.buffers[bufIdx-1])
-	// Ensure pageSize is bigger than sz.
-	for pageSize < minSz {
-		pageSize *= 2
-	}
-	// If bigger than maxAlloc, trim to maxAlloc.
-	if pageSize > maxAlloc {
-		pageSize = maxAlloc
-	}
-
-	buf := make([]byte, pageSize)
-	assert(len(a.buffers[bufIdx]) == 0)
-	a.buffers[bufIdx] = buf
-}
-
+// Allocate returns a slice of sz bytes, carved out of one of the Allocator's
+// shards. The shard's own bump pointer is advanced atomically; the Allocator's
+// Mutex is only taken on the rare occasion a shard needs a new buffer.
 func (a *Allocator) Allocate(sz int) []byte {
 	if a == nil {
 		return make([]byte, sz)
 	}
-	if sz > maxAlloc {
-		panic(fmt.Sprintf("Unable to allocate more than %d\n", maxAlloc))
+	if sz > a.effectiveMaxAlloc() {
+		panic(fmt.Sprintf("Unable to allocate more than %d\n", a.effectiveMaxAlloc()))
 	}
 	if sz == 0 {
 		return nil
 	}
+	sh := a.pickShard()
 	for {
-		pos := atomic.AddUint64(&a.compIdx, uint64(sz))
+		pos := atomic.AddUint64(&sh.compIdx, uint64(sz))
 		bufIdx, posIdx := parse(pos)
-		buf := a.buffers[bufIdx]
+		buf := sh.buffers[bufIdx]
 		if posIdx > len(buf) {
 			a.Lock()
-			newPos := atomic.LoadUint64(&a.compIdx)
+			newPos := atomic.LoadUint64(&sh.compIdx)
 			newBufIdx, _ := parse(newPos)
 			if newBufIdx != bufIdx {
 				a.Unlock()
 				continue
 			}
-			a.addBufferAt(bufIdx+1, sz)
-			atomic.StoreUint64(&a.compIdx, uint64((bufIdx+1)<<32))
+			newBufIdx = a.growShard(sh, bufIdx+1, sz)
+			atomic.StoreUint64(&sh.compIdx, uint64(newBufIdx)<<32)
 			a.Unlock()
-			// We added a new buffer. Let's acquire slice the right way by going back to the top.
+			// We added a new buffer. Let's slice the right way by going back to the top.
 			continue
 		}
 		data := buf[posIdx-sz : posIdx]
@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import "golang.org/x/sys/unix"
+
+// The x/sys/unix package doesn't expose MAP_HUGE_SHIFT or the per-size MAP_HUGE_*
+// flags, so encode them ourselves; they're a stable part of the Linux mmap(2) ABI.
+const mapHugeShift = 26
+
+// mmapAlloc requests anonymous memory of the given size from the OS. When
+// hugePageSize is non-zero, it first tries MAP_HUGETLB with the matching
+// MAP_HUGE_SHIFT-encoded size, falling back to a plain anonymous mapping if huge
+// pages aren't available. It returns nil if every attempt fails.
+func mmapAlloc(size int, hugePageSize int) []byte {
+	if hugePageSize > 0 {
+		flags := unix.MAP_ANON | unix.MAP_PRIVATE | unix.MAP_HUGETLB
+		switch hugePageSize {
+		case hugePage2MB:
+			flags |= 21 << mapHugeShift
+		case hugePage1GB:
+			flags |= 30 << mapHugeShift
+		}
+		if buf, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, flags); err == nil {
+			return buf
+		}
+		// Huge pages unavailable (not reserved, kernel support missing, etc).
+		// Fall through to a regular anonymous mapping.
+	}
+
+	buf, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil
+	}
+	return buf
+}
+
+// munmapFree releases memory obtained from mmapAlloc.
+func munmapFree(buf []byte) error {
+	return unix.Munmap(buf)
+}
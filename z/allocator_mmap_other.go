@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+// mmapAlloc is not supported outside Linux; callers fall back to the Go heap.
+func mmapAlloc(size int, hugePageSize int) []byte {
+	return nil
+}
+
+// munmapFree is unreachable outside Linux, since mmapAlloc never hands out a
+// buffer there.
+func munmapFree(buf []byte) error {
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import "os"
+
+// allocBackend selects where a new Allocator buffer's memory comes from.
+type allocBackend int
+
+const (
+	// backendHeap allocates buffers with make([]byte, ...), same as before
+	// AllocatorOption existed.
+	backendHeap allocBackend = iota
+	// backendMmap allocates buffers with an anonymous mmap.
+	backendMmap
+	// backendHugePage2MB is like backendMmap, but requests 2 MiB Linux huge pages.
+	backendHugePage2MB
+	// backendHugePage1GB is like backendMmap, but requests 1 GiB Linux huge pages.
+	backendHugePage1GB
+)
+
+const (
+	hugePage2MB = 2 << 20
+	hugePage1GB = 1 << 30
+)
+
+// hugePageSize returns the huge page size requested by backend, or 0 if backend
+// doesn't use huge pages.
+func (b allocBackend) hugePageSize() int {
+	switch b {
+	case backendHugePage2MB:
+		return hugePage2MB
+	case backendHugePage1GB:
+		return hugePage1GB
+	default:
+		return 0
+	}
+}
+
+// AllocatorOption configures how an Allocator created via NewAllocatorWithOptions
+// obtains the memory for its buffers.
+type AllocatorOption func(*Allocator)
+
+// WithMmap makes the Allocator request its buffers via an anonymous mmap instead
+// of the Go heap, falling back to the Go heap if the mmap call fails. Because the
+// returned memory holds no Go pointers, it is never scanned by the GC.
+func WithMmap() AllocatorOption {
+	return func(a *Allocator) {
+		a.backend = backendMmap
+	}
+}
+
+// WithHugePages is like WithMmap, but additionally requests 2 MiB Linux huge
+// pages, falling back to a plain mmap and then to the Go heap when huge pages
+// aren't available (e.g. none reserved in /proc/sys/vm/nr_hugepages, or not
+// running on Linux).
+func WithHugePages() AllocatorOption {
+	return func(a *Allocator) {
+		a.backend = backendHugePage2MB
+	}
+}
+
+// WithGigabyteHugePages is like WithHugePages, but requests 1 GiB huge pages.
+// Only useful for arenas of at least that size; smaller arenas should use
+// WithHugePages instead.
+func WithGigabyteHugePages() AllocatorOption {
+	return func(a *Allocator) {
+		a.backend = backendHugePage1GB
+	}
+}
+
+// WithNoZero skips zeroing buffers recycled from the global buffer pool
+// (see SetBufferPoolLimits). It saves a memclr on every reused buffer, but is
+// only safe when the caller always writes before reading.
+func WithNoZero() AllocatorOption {
+	return func(a *Allocator) {
+		a.noZero = true
+	}
+}
+
+// allocBuffer returns a buffer of at least size bytes, honoring a's configured
+// backend, and reports whether the buffer came from mmap (and must therefore
+// be released via munmapFree instead of left for the GC). It first tries to
+// recycle a buffer from the global buffer pool, querying it with the same
+// size the buffer will actually be allocated at -- for backendHeap that's
+// size itself, but for mmap/huge-page backends it's size rounded up to the
+// page/huge-page unit, since that's the capacity Release eventually puts
+// back into the pool.
+func (a *Allocator) allocBuffer(size int) ([]byte, bool) {
+	if a.backend == backendHeap {
+		if buf, mmapped, ok := globalBufferPool.get(size); ok {
+			a.zeroBuffer(buf)
+			return buf, mmapped
+		}
+		return make([]byte, size), false
+	}
+
+	unit := os.Getpagesize()
+	if hp := a.backend.hugePageSize(); hp > 0 {
+		unit = hp
+	}
+	rounded := roundUp(size, unit)
+	if buf, mmapped, ok := globalBufferPool.get(rounded); ok {
+		a.zeroBuffer(buf)
+		return buf, mmapped
+	}
+	if buf := mmapAlloc(rounded, a.backend.hugePageSize()); buf != nil {
+		return buf, true
+	}
+	// mmap failed -- e.g. huge pages weren't reserved, or we're on a platform
+	// without mmap support. Fall back to the Go heap.
+	return make([]byte, size), false
+}
+
+// zeroBuffer clears a buffer recycled from the global buffer pool, unless the
+// Allocator was built with WithNoZero.
+func (a *Allocator) zeroBuffer(buf []byte) {
+	if a.noZero {
+		return
+	}
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+// roundUp rounds size up to the next multiple of unit.
+func roundUp(size, unit int) int {
+	if unit <= 0 {
+		return size
+	}
+	return (size + unit - 1) / unit * unit
+}
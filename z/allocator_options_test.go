@@ -0,0 +1,69 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import "testing"
+
+// TestNewAllocatorWithOptionsMmap exercises a WithMmap-backed Allocator
+// end-to-end: allocate, write, read back, then Release without crashing or
+// leaking the mapping.
+func TestNewAllocatorWithOptionsMmap(t *testing.T) {
+	a := NewAllocatorWithOptions(4096, WithMmap())
+	defer a.Release()
+
+	buf := a.Allocate(128)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	for i, b := range buf {
+		if b != byte(i) {
+			t.Fatalf("buf[%d] = %d, want %d", i, b, byte(i))
+		}
+	}
+}
+
+// TestNewAllocatorWithOptionsHugePagesFallsBack exercises WithHugePages in an
+// environment where huge pages are very likely not reserved (this sandbox),
+// so the allocator must fall back to a plain mmap (and ultimately the Go
+// heap) rather than fail.
+func TestNewAllocatorWithOptionsHugePagesFallsBack(t *testing.T) {
+	a := NewAllocatorWithOptions(4096, WithHugePages())
+	defer a.Release()
+
+	buf := a.Allocate(128)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	for i, b := range buf {
+		if b != byte(i) {
+			t.Fatalf("buf[%d] = %d, want %d", i, b, byte(i))
+		}
+	}
+}
+
+// TestNewAllocatorWithOptionsPanicsAboveHugePageSize checks the
+// effectiveMaxAlloc path: a huge-page-backed Allocator can't satisfy a single
+// allocation bigger than its huge page size, even though maxAlloc (1 GiB) is
+// bigger, and must panic rather than silently truncate.
+func TestNewAllocatorWithOptionsPanicsAboveHugePageSize(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("expected a panic for a request bigger than the 2MiB huge page size")
+		}
+	}()
+	NewAllocatorWithOptions(hugePage2MB+1, WithHugePages())
+}
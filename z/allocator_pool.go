@@ -0,0 +1,122 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import "sync"
+
+// poolMaxBufferSize is the largest buffer capacity the global buffer pool will
+// hold on to. Allocators churning arenas bigger than this are rare enough that
+// recycling them isn't worth the RSS they'd pin down.
+const poolMaxBufferSize = 32 << 20 // 32 MiB
+
+// Defaults for globalBufferPool, overridable via SetBufferPoolLimits.
+const (
+	defaultPoolPerBucket = 16
+	defaultPoolMaxBytes  = 256 << 20 // 256 MiB
+)
+
+// pooledBuffer is a buffer sitting in the pool, along with enough information
+// to release it properly if it's ever evicted instead of reused.
+type pooledBuffer struct {
+	buf     []byte
+	mmapped bool
+}
+
+// bufferPool is a process-wide, size-class-indexed free list of buffers handed
+// back by Allocator.Release. Buffers are bucketed by capacity, which is always
+// a power of two for buffers produced by Allocator (see growShard).
+type bufferPool struct {
+	mu        sync.Mutex
+	buckets   map[int][]pooledBuffer
+	perBucket int
+	maxBytes  uint64
+	heldBytes uint64
+}
+
+var globalBufferPool = &bufferPool{
+	buckets:   make(map[int][]pooledBuffer),
+	perBucket: defaultPoolPerBucket,
+	maxBytes:  defaultPoolMaxBytes,
+}
+
+// SetBufferPoolLimits configures the global buffer pool used to recycle
+// released Allocator buffers: perBucket caps how many buffers of a given
+// power-of-two size are kept, and maxBytes caps the pool's total size. Both
+// limits apply going forward; they don't retroactively evict buffers already
+// held (use DrainBufferPool for that).
+func SetBufferPoolLimits(perBucket int, maxBytes uint64) {
+	globalBufferPool.mu.Lock()
+	defer globalBufferPool.mu.Unlock()
+	globalBufferPool.perBucket = perBucket
+	globalBufferPool.maxBytes = maxBytes
+}
+
+// DrainBufferPool empties the global buffer pool, releasing any mmapped
+// buffers it held. It's meant for tests that want a clean slate between runs.
+func DrainBufferPool() {
+	globalBufferPool.mu.Lock()
+	buckets := globalBufferPool.buckets
+	globalBufferPool.buckets = make(map[int][]pooledBuffer)
+	globalBufferPool.heldBytes = 0
+	globalBufferPool.mu.Unlock()
+
+	for _, bucket := range buckets {
+		for _, pb := range bucket {
+			if pb.mmapped {
+				_ = munmapFree(pb.buf)
+			}
+		}
+	}
+}
+
+// get pops a buffer of exactly the given capacity from the pool, if any.
+func (p *bufferPool) get(size int) (buf []byte, mmapped bool, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	bucket := p.buckets[size]
+	if len(bucket) == 0 {
+		return nil, false, false
+	}
+	last := bucket[len(bucket)-1]
+	p.buckets[size] = bucket[:len(bucket)-1]
+	p.heldBytes -= uint64(cap(last.buf))
+	return last.buf, last.mmapped, true
+}
+
+// put hands a released buffer back to the pool, dropping it (for the caller to
+// dispose of however is appropriate for its backend) if it's too big, or its
+// bucket or the pool as a whole is already full.
+func (p *bufferPool) put(buf []byte, mmapped bool) (accepted bool) {
+	sz := cap(buf)
+	if sz == 0 || sz > poolMaxBufferSize {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.perBucket > 0 && len(p.buckets[sz]) >= p.perBucket {
+		return false
+	}
+	if p.maxBytes > 0 && p.heldBytes+uint64(sz) > p.maxBytes {
+		return false
+	}
+	p.buckets[sz] = append(p.buckets[sz], pooledBuffer{buf: buf, mmapped: mmapped})
+	p.heldBytes += uint64(sz)
+	return true
+}
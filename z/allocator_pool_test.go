@@ -0,0 +1,48 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import "testing"
+
+// TestAllocBufferMmapPoolRoundTrip guards against allocBuffer querying the
+// global buffer pool with a different size than the one a released mmap
+// buffer is later put back under: allocBuffer rounds size up to the page (or
+// huge page) unit before handing memory to a mmap/huge-page-backed
+// Allocator, and Release pools the result keyed by its actual capacity, so
+// allocBuffer must query the pool with that same rounded size.
+func TestAllocBufferMmapPoolRoundTrip(t *testing.T) {
+	DrainBufferPool()
+	defer DrainBufferPool()
+
+	a := &Allocator{backend: backendMmap}
+
+	buf, mmapped := a.allocBuffer(1)
+	if !globalBufferPool.put(buf, mmapped) {
+		t.Fatalf("pool rejected a freshly allocated buffer")
+	}
+
+	got, _, ok := globalBufferPool.get(cap(buf))
+	if !ok || &got[0] != &buf[0] {
+		t.Fatalf("pool did not return the buffer put back under its own capacity")
+	}
+	globalBufferPool.put(got, mmapped)
+
+	buf2, _ := a.allocBuffer(1)
+	if &buf2[0] != &buf[0] {
+		t.Fatalf("allocBuffer(1) queried the pool with a size that didn't match the capacity buffers of this kind are pooled under")
+	}
+}
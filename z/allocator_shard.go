@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"fmt"
+	"math/bits"
+	"runtime"
+	"sync/atomic"
+)
+
+// maxShardBuffers bounds how many times a single shard's buffer can double.
+// Doubling from even a 1-byte buffer reaches maxAlloc well before 63 rounds,
+// so this is only ever hit by a caller that keeps the Allocator alive forever.
+const maxShardBuffers = 63
+
+// allocShard is one Allocator bump-pointer lane. Each shard owns its own run of
+// buffers and its own compIdx cursor (packed exactly like the Allocator-wide
+// counter this replaced: bufIdx in the 32 MSBs, posIdx in the 32 LSBs), so
+// concurrent callers hashed to different shards never contend on the same cache
+// line. buffers and mmapped are fixed-size arrays, grown by setting individual
+// elements rather than appending, so a concurrent read of buffers[i] can never
+// race with another goroutine resizing the slice header.
+type allocShard struct {
+	compIdx uint64
+	buffers [][]byte
+	mmapped []bool
+	_       [32]byte // pad out to reduce false sharing between shards
+}
+
+// newShards creates one allocShard per GOMAXPROCS CPU, each with its own first
+// buffer already in place so Allocate's grow-the-next-buffer logic never has
+// to special-case an empty shard. The initial size passed to NewAllocator is
+// split evenly across shards rather than given to each of them in full --
+// otherwise total eager allocation on construction would scale with
+// GOMAXPROCS instead of matching the requested size. Shards grow from there
+// via the existing doubling path in growShard.
+func (a *Allocator) newShards() []*allocShard {
+	n := runtime.GOMAXPROCS(0)
+	if n < 1 {
+		n = 1
+	}
+	firstBufSize := roundPow2((a.initialSize + n - 1) / n)
+	shards := make([]*allocShard, n)
+	for i := range shards {
+		sh := &allocShard{
+			buffers: make([][]byte, maxShardBuffers),
+			mmapped: make([]bool, maxShardBuffers),
+		}
+		buf, mmapped := a.allocBuffer(firstBufSize)
+		sh.buffers[0] = buf
+		sh.mmapped[0] = mmapped
+		shards[i] = sh
+	}
+	return shards
+}
+
+// pickShard hands back one of the Allocator's shards via an atomic round-robin
+// counter. This is simpler than pinning to the calling goroutine's P
+// (runtime_procPin) and just as effective at spreading load: the only shared
+// state is a single counter increment, not the bump pointer itself.
+func (a *Allocator) pickShard() *allocShard {
+	i := atomic.AddUint64(&a.shardPick, 1)
+	return a.shards[i%uint64(len(a.shards))]
+}
+
+// growShard installs a new buffer at or after sh.buffers[bufIdx], doubling the
+// size of the shard's previous buffer, capped at maxAlloc, and returns the
+// index the new (or reused) buffer ended up at. Callers must hold a.Mutex.
+//
+// If sh.buffers[bufIdx] is already occupied, growShard walks forward looking
+// for either an empty slot or one already big enough to satisfy minSz, rather
+// than overwriting it in place -- doing so in place would detach whatever was
+// there from sh.buffers with nothing left to reference it, leaking the mmap
+// behind it for mmap/huge-page-backed Allocators.
+func (a *Allocator) growShard(sh *allocShard, bufIdx, minSz int) int {
+	for {
+		if bufIdx >= len(sh.buffers) {
+			panic(fmt.Sprintf("allocShard can not allocate more than %d buffers", len(sh.buffers)))
+		}
+		if len(sh.buffers[bufIdx]) == 0 {
+			break
+		}
+		if minSz <= len(sh.buffers[bufIdx]) {
+			// No need to do anything. We already have a buffer which can satisfy minSz.
+			return bufIdx
+		}
+		bufIdx++
+	}
+
+	// Make pageSize double of the shard's last buffer.
+	pageSize := 2 * len(sh.buffers[bufIdx-1])
+	for pageSize < minSz {
+		pageSize *= 2
+	}
+	if pageSize > maxAlloc {
+		pageSize = maxAlloc
+	}
+
+	buf, mmapped := a.allocBuffer(pageSize)
+	sh.buffers[bufIdx] = buf
+	sh.mmapped[bufIdx] = mmapped
+	return bufIdx
+}
+
+// roundPow2 rounds sz up to the next power of 2.
+func roundPow2(sz int) int {
+	l2 := uint64(log2(sz))
+	if bits.OnesCount64(uint64(sz)) > 1 {
+		// If sz has a single bit set, it is already a power of 2. Otherwise, bump up
+		// to the next one.
+		l2++
+	}
+	return 1 << l2
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import "testing"
+
+// TestNewShardsSplitsInitialSizeAcrossShards guards against newShards giving
+// every shard a full-size first buffer: total eager allocation on
+// construction should track the requested size, not the requested size times
+// the shard count.
+func TestNewShardsSplitsInitialSizeAcrossShards(t *testing.T) {
+	a := NewAllocator(1 << 20)
+	defer a.Release()
+
+	n := len(a.shards)
+	if n < 2 {
+		t.Skip("need at least 2 shards (GOMAXPROCS >= 2) to observe the regression")
+	}
+
+	got := a.Allocated()
+	if got > uint64(2<<20) {
+		t.Fatalf("Allocated() = %d, expected roughly the requested 1MiB regardless of %d shards", got, n)
+	}
+}
+
+// TestGrowShardKeepsOccupiedSlotAfterReset exercises the case where a shard's
+// cursor rewinds (e.g. via Reset) back into a buffer slot that's already
+// occupied by a too-small buffer from an earlier growth cycle: growShard must
+// walk forward to a fresh slot instead of overwriting the occupied one, or
+// the buffer sitting there would be silently detached from sh.buffers with
+// nothing left to reference it.
+func TestGrowShardKeepsOccupiedSlotAfterReset(t *testing.T) {
+	a := NewAllocator(64)
+	defer a.Release()
+
+	sh := a.shards[0]
+	occupied := sh.buffers[1]
+	if len(occupied) == 0 {
+		a.Lock()
+		a.growShard(sh, 1, 64)
+		a.Unlock()
+		occupied = sh.buffers[1]
+	}
+
+	a.Lock()
+	gotIdx := a.growShard(sh, 1, len(occupied)+1)
+	a.Unlock()
+
+	if &sh.buffers[1][0] != &occupied[0] {
+		t.Fatalf("growShard overwrote an occupied slot instead of walking forward")
+	}
+	if gotIdx != 2 || len(sh.buffers[2]) == 0 {
+		t.Fatalf("expected growShard to install the larger buffer at buffers[2], got idx %d", gotIdx)
+	}
+}
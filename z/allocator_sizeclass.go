@@ -0,0 +1,172 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"sort"
+	"unsafe"
+)
+
+// maxClassSize is the largest request AllocateClass will serve from a size
+// class; anything bigger falls through to Allocate unchanged.
+const maxClassSize = 32 << 10 // 32 KiB
+
+// slabObjects is how many objects of a given class are carved out of a single
+// Allocate call when a class's freelist runs dry.
+const slabObjects = 64
+
+// sizeClasses holds the small-object size classes, smallest first, generated
+// once at init. Spacing mirrors the Go runtime's mallocgc class table: a tight
+// step near the bottom, widening geometrically as sizes grow, so rounding
+// waste stays under 20% of the class size for every class above 128 bytes
+// (it is higher for the smallest classes, e.g. 33 bytes rounds up to 48).
+var sizeClasses []int
+
+// sizeClassIndex maps a class's exact size back to its index in sizeClasses,
+// used by FreeClass to find the freelist a buffer came from.
+var sizeClassIndex map[int]int
+
+func init() {
+	sizeClasses = generateSizeClasses()
+	sizeClassIndex = make(map[int]int, len(sizeClasses))
+	for i, sz := range sizeClasses {
+		sizeClassIndex[sz] = i
+	}
+}
+
+// generateSizeClasses builds the ascending size-class table up to
+// maxClassSize, doubling the step each time a class lands on a multiple of
+// eight steps (at 128, 256, 512, ...).
+func generateSizeClasses() []int {
+	classes := []int{8, 16, 24, 32}
+	step := 16
+	for classes[len(classes)-1] < maxClassSize {
+		next := classes[len(classes)-1] + step
+		if next > maxClassSize {
+			next = maxClassSize
+		}
+		classes = append(classes, next)
+		if next%(step*8) == 0 {
+			step *= 2
+		}
+	}
+	return classes
+}
+
+// classIndexAtLeast returns the index of the smallest size class that can
+// hold sz bytes, or -1 if sz is bigger than every class.
+func classIndexAtLeast(sz int) int {
+	i := sort.Search(len(sizeClasses), func(i int) bool { return sizeClasses[i] >= sz })
+	if i == len(sizeClasses) {
+		return -1
+	}
+	return i
+}
+
+// AllocateClass returns a buffer of exactly sz bytes, served from the
+// freelist of the smallest size class that fits sz. A class's freelist is a
+// stack threaded through the free buffers themselves, guarded by a small
+// per-class mutex: the first machine word of a free buffer points at the next
+// free buffer, nil meaning the list is empty. On a freelist miss, a fresh slab
+// of slabObjects same-class buffers is carved out of a.Allocate, one is
+// returned and the rest are pushed onto the freelist.
+//
+// Requests bigger than the largest class fall through to Allocate unchanged,
+// and must be released with a.Allocate's normal "release the whole Allocator"
+// semantics -- only buffers that came from AllocateClass may be passed to
+// FreeClass.
+func (a *Allocator) AllocateClass(sz int) []byte {
+	if a == nil {
+		return make([]byte, sz)
+	}
+	if sz <= 0 {
+		return nil
+	}
+	ci := classIndexAtLeast(sz)
+	if ci < 0 {
+		return a.Allocate(sz)
+	}
+	classSize := sizeClasses[ci]
+
+	if buf := a.popFreeClass(ci, classSize); buf != nil {
+		// pushFreeClass wrote the freelist link into buf's first machine word,
+		// so a freelist hit must be zeroed (like any other recycled buffer,
+		// honoring noZero) before the caller sees it -- otherwise a stale
+		// pointer value leaks into what's supposed to be fresh memory.
+		a.zeroBuffer(buf)
+		return buf[:sz]
+	}
+
+	// Carved via AllocateAligned, not Allocate: pushFreeClass/popFreeClass read
+	// and write a machine word through an unsafe.Pointer at each piece's start,
+	// which is undefined behavior if that address isn't pointer-aligned.
+	//
+	// Three-index slices cap each carved-out piece at exactly classSize, rather
+	// than at the remaining capacity of the underlying slab. FreeClass relies on
+	// cap(buf) == classSize to find the right freelist, so without the third
+	// index every piece but the very last would report the slab's tail capacity
+	// instead of its own class size.
+	slab := a.AllocateAligned(classSize * slabObjects)
+	for i := 1; i < slabObjects; i++ {
+		a.pushFreeClass(ci, slab[i*classSize:(i+1)*classSize:(i+1)*classSize])
+	}
+	return slab[0:classSize:classSize][:sz]
+}
+
+// FreeClass returns a buffer obtained from AllocateClass to its class's
+// freelist, making it available for the next AllocateClass call of the same
+// class. It does not touch any shard's bump pointer; the underlying arena is
+// only ever reclaimed in bulk via Allocator.Release.
+func (a *Allocator) FreeClass(buf []byte) {
+	if a == nil || len(buf) == 0 {
+		return
+	}
+	ci, ok := sizeClassIndex[cap(buf)]
+	if !ok {
+		// Not a buffer AllocateClass handed out; nothing sane to do with it.
+		return
+	}
+	a.pushFreeClass(ci, buf[:cap(buf)])
+}
+
+// popFreeClass pops a buffer off class ci's freelist, or returns nil if it's
+// empty.
+func (a *Allocator) popFreeClass(ci, classSize int) []byte {
+	mu := &a.classMus[ci]
+	mu.Lock()
+	defer mu.Unlock()
+
+	head := a.classFreelists[ci]
+	if head == nil {
+		return nil
+	}
+	a.classFreelists[ci] = *(*unsafe.Pointer)(head)
+	return unsafe.Slice((*byte)(head), classSize)
+}
+
+// pushFreeClass pushes buf onto class ci's freelist, overwriting its first
+// machine word with the previous head.
+func (a *Allocator) pushFreeClass(ci int, buf []byte) {
+	head := unsafe.Pointer(&buf[0])
+
+	mu := &a.classMus[ci]
+	mu.Lock()
+	defer mu.Unlock()
+
+	*(*unsafe.Pointer)(head) = a.classFreelists[ci]
+	a.classFreelists[ci] = head
+}
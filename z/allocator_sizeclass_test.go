@@ -0,0 +1,63 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import "testing"
+
+func TestAllocateClassReusesFreedBuffer(t *testing.T) {
+	a := NewAllocator(1024)
+	defer a.Release()
+
+	buf1 := a.AllocateClass(8)
+	addr1 := &buf1[0]
+	a.FreeClass(buf1)
+
+	buf2 := a.AllocateClass(8)
+	addr2 := &buf2[0]
+	if addr1 != addr2 {
+		t.Fatalf("AllocateClass did not reuse the freed buffer: addr1=%p addr2=%p", addr1, addr2)
+	}
+}
+
+func TestAllocateClassZeroesReusedBuffer(t *testing.T) {
+	a := NewAllocator(1024)
+	defer a.Release()
+
+	buf1 := a.AllocateClass(8)
+	for i := range buf1 {
+		buf1[i] = 0xAB
+	}
+	a.FreeClass(buf1)
+
+	buf2 := a.AllocateClass(8)
+	for i, b := range buf2 {
+		if b != 0 {
+			t.Fatalf("buf2[%d] = %#x, want 0 (stale freelist link leaked into a reused buffer)", i, b)
+		}
+	}
+}
+
+func TestAllocateClassCapMatchesClassSize(t *testing.T) {
+	a := NewAllocator(1024)
+	defer a.Release()
+
+	buf := a.AllocateClass(8)
+	ci := classIndexAtLeast(8)
+	if cap(buf) != sizeClasses[ci] {
+		t.Fatalf("cap(buf) = %d, want %d", cap(buf), sizeClasses[ci])
+	}
+}